@@ -18,30 +18,51 @@ package huaweicloud
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 
 	lru "github.com/hashicorp/golang-lru"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
 )
 
 const (
-	ELBIDAnnotation            = "kubernetes.io/elb.id"
-	ELBClassAnnotation         = "kubernetes.io/elb.class"
-	ELBMarkAnnotation          = "kubernetes.io/elb.mark"
-	VPCIDAnnotation            = "kubernetes.io/elb.vpc.id"
-	ELBSessionAffinityMode     = "kubernetes.io/session-affinity-mode"
-	ELBSessionSourceIP         = "SOURCE_IP"
+	ELBIDAnnotation        = "kubernetes.io/elb.id"
+	ELBClassAnnotation     = "kubernetes.io/elb.class"
+	ELBMarkAnnotation      = "kubernetes.io/elb.mark"
+	VPCIDAnnotation        = "kubernetes.io/elb.vpc.id"
+	ELBSessionAffinityMode = "kubernetes.io/session-affinity-mode"
+	ELBSessionSourceIP     = "SOURCE_IP"
+	// ELBSessionAffinityFlag turns session affinity on/off independently of
+	// the legacy ELBSessionAffinityMode annotation.
+	ELBSessionAffinityFlag = "kubernetes.io/elb.session-affinity-flag"
+	// ELBSessionAffinityOption carries a JSON-encoded SessionAffinityOption.
+	ELBSessionAffinityOption = "kubernetes.io/elb.session-affinity-option"
+	// ELBHealthCheckOption carries a JSON-encoded HealthCheckOption.
+	ELBHealthCheckOption       = "kubernetes.io/elb.health-check-option"
 	Ping                       = "ping"
 	Pong                       = "pong"
 	HealthzCCE                 = "cce-healthz"
 	ListenerDescription        = "Attention! It is auto-generated by CCE service, do not modify!"
 	DefaultSessionAffinityTime = 1440
+
+	// LabelNodeExcludeBalancer, when present on a Node (with any value),
+	// marks it ineligible for inclusion in any load balancer pool.
+	LabelNodeExcludeBalancer = "node.kubernetes.io/exclude-from-external-load-balancers"
+	// LabelAlphaExcludeBalancer is the legacy form of LabelNodeExcludeBalancer.
+	LabelAlphaExcludeBalancer = "alpha.service-controller.kubernetes.io/exclude-balancer"
+	// LabelNodeRoleMaster marks a control-plane node, which never receives
+	// Service traffic.
+	LabelNodeRoleMaster = "node-role.kubernetes.io/master"
 )
 
 type LoadBalancerOpts struct {
@@ -77,16 +98,22 @@ const (
 	VersionELB
 	VersionALB
 	VersionNAT
+	VersionUPnP
 )
 
 // NewLoadBalancer creates a load balancer handler.
-func NewLoadBalancer(lrucache *lru.Cache, loadBalancerConf *LoadBalancerOpts, kubeClient corev1.CoreV1Interface, eventRecorder record.EventRecorder) *LoadBalancer {
+func NewLoadBalancer(lrucache *lru.Cache, loadBalancerConf *LoadBalancerOpts, kubeClient corev1.CoreV1Interface, serviceLister corelisters.ServiceLister, endpointsLister corelisters.EndpointsLister, eventRecorder record.EventRecorder) *LoadBalancer {
 	lb := LoadBalancer{}
-	lb.providers = make(map[LoadBalanceVersion]cloudprovider.LoadBalancer, 3)
+	lb.providers = make(map[LoadBalanceVersion]cloudprovider.LoadBalancer, 4)
+	lb.lrucache = lrucache
+	lb.serviceLister = serviceLister
+	lb.endpointsLister = endpointsLister
+	lb.eventRecorder = eventRecorder
 
 	lb.providers[VersionELB] = &ELBCloud{lrucache: lrucache, config: loadBalancerConf, kubeClient: kubeClient, eventRecorder: eventRecorder}
 	lb.providers[VersionALB] = &ALBCloud{lrucache: lrucache, config: loadBalancerConf, kubeClient: kubeClient, eventRecorder: eventRecorder}
 	lb.providers[VersionNAT] = &NATCloud{lrucache: lrucache, config: loadBalancerConf, kubeClient: kubeClient, eventRecorder: eventRecorder}
+	lb.providers[VersionUPnP] = &UPnPCloud{lrucache: lrucache, config: loadBalancerConf, kubeClient: kubeClient, eventRecorder: eventRecorder, listeners: make(map[string]*upnpListener)}
 
 	return &lb
 }
@@ -94,6 +121,269 @@ func NewLoadBalancer(lrucache *lru.Cache, loadBalancerConf *LoadBalancerOpts, ku
 // LoadBalancer represents all kinds of load balancer.
 type LoadBalancer struct {
 	providers map[LoadBalanceVersion]cloudprovider.LoadBalancer
+
+	// lrucache caches, per Service, the last snapshot that was successfully
+	// reconciled so that UpdateLoadBalancer can skip redundant Huawei API
+	// calls via NeedUpdate.
+	lrucache *lru.Cache
+
+	// serviceLister is used to re-fetch the current Service immediately
+	// before a reconcile is dispatched to a provider, so that stale
+	// snapshots queued earlier don't clobber newer changes.
+	serviceLister corelisters.ServiceLister
+	// endpointsLister is consulted when a Service's ExternalTrafficPolicy
+	// is Local, to restrict the load balancer pool to nodes that currently
+	// host a Ready endpoint.
+	endpointsLister corelisters.EndpointsLister
+	eventRecorder   record.EventRecorder
+
+	// serviceLocks serializes EnsureLoadBalancer/UpdateLoadBalancer/
+	// EnsureLoadBalancerDeleted per Service so that the node-sync path and
+	// the service-reconcile path can't race on the same ELB/ALB/NAT.
+	serviceLocks sync.Map // map[string]*sync.Mutex, keyed by serviceLockKey
+}
+
+func serviceLockKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+// lockService locks the mutex guarding reconciles for the given Service,
+// creating it on first use, and returns the function that unlocks it.
+func (lb *LoadBalancer) lockService(service *v1.Service) func() {
+	value, _ := lb.serviceLocks.LoadOrStore(serviceLockKey(service), &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// forgetServiceLock drops the per-Service mutex from serviceLocks once the
+// Service is gone, so a high-churn cluster doesn't accumulate one
+// *sync.Mutex per Service ever seen.
+func (lb *LoadBalancer) forgetServiceLock(service *v1.Service) {
+	lb.serviceLocks.Delete(serviceLockKey(service))
+}
+
+// refreshService re-fetches the Service from the lister so the provider
+// operates on the latest known annotations/ports rather than the snapshot
+// that was queued for this reconcile. It reports ok=false when the caller
+// should treat current as unusable: the Service was deleted, or its LB
+// class annotation changed between enqueue and processing. recordSkipEvent
+// should be false for callers that proceed regardless of ok (the delete
+// path falls back to the stale Service it was handed), since emitting a
+// "skipping" event for a reconcile that isn't actually skipped is
+// misleading.
+func (lb *LoadBalancer) refreshService(service *v1.Service, recordSkipEvent bool) (current *v1.Service, ok bool, err error) {
+	if lb.serviceLister == nil {
+		return service, true, nil
+	}
+
+	current, err = lb.serviceLister.Services(service.Namespace).Get(service.Name)
+	if apierrors.IsNotFound(err) {
+		if recordSkipEvent {
+			lb.recordSkip(service, "Service no longer exists, skipping load balancer reconcile")
+		}
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if current.Annotations[ELBClassAnnotation] != service.Annotations[ELBClassAnnotation] {
+		if recordSkipEvent {
+			lb.recordSkip(service, "Service load balancer class annotation changed since this reconcile was enqueued, skipping")
+		}
+		return nil, false, nil
+	}
+
+	return current, true, nil
+}
+
+// reconcileCacheEntry is what LoadBalancer.lrucache stores for the
+// NeedUpdate fast path: the Service and filtered node set as of the last
+// successful UpdateLoadBalancer call.
+type reconcileCacheEntry struct {
+	service *v1.Service
+	nodes   []*v1.Node
+}
+
+func reconcileCacheKey(service *v1.Service) string {
+	return "reconcile/" + service.Namespace + "/" + service.Name
+}
+
+// NeedUpdate reports whether any field that affects the ELB/ALB/NAT
+// configuration differs between old and new: ports, session affinity,
+// source ranges, external traffic policy, and the ELB/ALB/NAT-relevant
+// annotations. Unrelated churn (e.g. status, unrelated annotations) is
+// ignored so UpdateLoadBalancer can skip a reconcile when this returns
+// false.
+func NeedUpdate(old, new *v1.Service) bool {
+	if old == nil || new == nil {
+		return true
+	}
+
+	if !reflect.DeepEqual(old.Spec.Ports, new.Spec.Ports) {
+		return true
+	}
+	if old.Spec.SessionAffinity != new.Spec.SessionAffinity {
+		return true
+	}
+	if !stringSlicesEqual(old.Spec.LoadBalancerSourceRanges, new.Spec.LoadBalancerSourceRanges) {
+		return true
+	}
+	if old.Spec.ExternalTrafficPolicy != new.Spec.ExternalTrafficPolicy {
+		return true
+	}
+	if !reflect.DeepEqual(relevantAnnotations(old), relevantAnnotations(new)) {
+		return true
+	}
+
+	return false
+}
+
+// relevantAnnotations returns the subset of a Service's annotations that
+// influence ELB/ALB/NAT configuration.
+func relevantAnnotations(service *v1.Service) map[string]string {
+	relevant := make(map[string]string)
+	for key, value := range service.Annotations {
+		if key == ELBSessionAffinityMode || strings.HasPrefix(key, "kubernetes.io/elb.") {
+			relevant[key] = value
+		}
+	}
+	return relevant
+}
+
+// NodeConditionChanged reports whether old and new differ in the node
+// health signal used for load balancer pool membership.
+func NodeConditionChanged(old, new *v1.Node) bool {
+	oldHealthy, _ := CheckNodeHealth(old)
+	newHealthy, _ := CheckNodeHealth(new)
+	return oldHealthy != newHealthy
+}
+
+// nodeSlicesEqual reports whether old and new represent the same load
+// balancer pool: same set of node names, none of which changed health
+// condition.
+func nodeSlicesEqual(old, new []*v1.Node) bool {
+	if len(old) != len(new) {
+		return false
+	}
+
+	oldByName := make(map[string]*v1.Node, len(old))
+	for _, node := range old {
+		oldByName[node.Name] = node
+	}
+
+	for _, node := range new {
+		prev, ok := oldByName[node.Name]
+		if !ok {
+			return false
+		}
+		if NodeConditionChanged(prev, node) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// filterNodesForService narrows nodes down to the set that is actually
+// eligible to receive traffic for service: nodes excluded from load
+// balancing, master nodes, and unhealthy/cordoned nodes are always dropped;
+// when service uses ExternalTrafficPolicy=Local, nodes without a Ready
+// endpoint for the Service are dropped too, mirroring upstream
+// service-controller semantics so pools never include nodes that would
+// blackhole traffic.
+func (lb *LoadBalancer) filterNodesForService(service *v1.Service, nodes []*v1.Node) ([]*v1.Node, error) {
+	var endpointNodes map[string]bool
+	if service.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		var err error
+		endpointNodes, err = lb.nodesWithReadyEndpoints(service)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filtered := make([]*v1.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if _, excluded := node.Labels[LabelNodeExcludeBalancer]; excluded {
+			continue
+		}
+		if _, excluded := node.Labels[LabelAlphaExcludeBalancer]; excluded {
+			continue
+		}
+		if _, isMaster := node.Labels[LabelNodeRoleMaster]; isMaster {
+			continue
+		}
+
+		healthy, err := CheckNodeHealth(node)
+		if err != nil {
+			return nil, err
+		}
+		if !healthy {
+			continue
+		}
+
+		if endpointNodes != nil && !endpointNodes[node.Name] {
+			continue
+		}
+
+		filtered = append(filtered, node)
+	}
+
+	return filtered, nil
+}
+
+// nodesWithReadyEndpoints returns the set of node names currently hosting a
+// Ready endpoint address of service.
+func (lb *LoadBalancer) nodesWithReadyEndpoints(service *v1.Service) (map[string]bool, error) {
+	if lb.endpointsLister == nil {
+		return nil, fmt.Errorf("no endpoints lister configured, cannot honor ExternalTrafficPolicy=Local for service %s", service.Name)
+	}
+
+	endpoints, err := lb.endpointsLister.Endpoints(service.Namespace).Get(service.Name)
+	if apierrors.IsNotFound(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]bool)
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil {
+				nodes[*addr.NodeName] = true
+			}
+		}
+	}
+
+	return nodes, nil
+}
+
+func (lb *LoadBalancer) recordSkip(service *v1.Service, message string) {
+	if lb.eventRecorder == nil {
+		return
+	}
+	lb.eventRecorder.Event(service, v1.EventTypeNormal, "LoadBalancerReconcileSkipped", message)
+}
+
+func (lb *LoadBalancer) recordInvalidAnnotations(service *v1.Service, err error) {
+	if lb.eventRecorder == nil {
+		return
+	}
+	lb.eventRecorder.Eventf(service, v1.EventTypeWarning, "InvalidLoadBalancerAnnotation", "%v", err)
 }
 
 // Check if our LoadBalancer implements necessary interface
@@ -129,6 +419,27 @@ func (lb *LoadBalancer) GetLoadBalancerName(ctx context.Context, clusterName str
 // parameters as read-only and not modify them.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 func (lb *LoadBalancer) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	unlock := lb.lockService(service)
+	defer unlock()
+
+	service, ok, err := lb.refreshService(service, true)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	if err := ValidateServiceAnnotations(service); err != nil {
+		lb.recordInvalidAnnotations(service, err)
+		return nil, err
+	}
+
+	nodes, err = lb.filterNodesForService(service, nodes)
+	if err != nil {
+		return nil, err
+	}
+
 	LBVersion, err := getLoadBalancerVersion(service)
 	if err != nil {
 		return nil, err
@@ -147,6 +458,37 @@ func (lb *LoadBalancer) EnsureLoadBalancer(ctx context.Context, clusterName stri
 // parameters as read-only and not modify them.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 func (lb *LoadBalancer) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	unlock := lb.lockService(service)
+	defer unlock()
+
+	service, ok, err := lb.refreshService(service, true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	if err := ValidateServiceAnnotations(service); err != nil {
+		lb.recordInvalidAnnotations(service, err)
+		return err
+	}
+
+	nodes, err = lb.filterNodesForService(service, nodes)
+	if err != nil {
+		return err
+	}
+
+	if lb.lrucache != nil {
+		if cached, found := lb.lrucache.Get(reconcileCacheKey(service)); found {
+			entry := cached.(*reconcileCacheEntry)
+			if !NeedUpdate(entry.service, service) && nodeSlicesEqual(entry.nodes, nodes) {
+				lb.recordSkip(service, "no load balancer-relevant change since the last reconcile, skipping")
+				return nil
+			}
+		}
+	}
+
 	LBVersion, err := getLoadBalancerVersion(service)
 	if err != nil {
 		return err
@@ -157,7 +499,15 @@ func (lb *LoadBalancer) UpdateLoadBalancer(ctx context.Context, clusterName stri
 		return nil
 	}
 
-	return provider.UpdateLoadBalancer(ctx, clusterName, service, nodes)
+	if err := provider.UpdateLoadBalancer(ctx, clusterName, service, nodes); err != nil {
+		return err
+	}
+
+	if lb.lrucache != nil {
+		lb.lrucache.Add(reconcileCacheKey(service), &reconcileCacheEntry{service: service.DeepCopy(), nodes: nodes})
+	}
+
+	return nil
 }
 
 // EnsureLoadBalancerDeleted deletes the specified load balancer if it
@@ -169,6 +519,29 @@ func (lb *LoadBalancer) UpdateLoadBalancer(ctx context.Context, clusterName stri
 // Implementations must treat the *v1.Service parameter as read-only and not modify it.
 // Parameter 'clusterName' is the name of the cluster as presented to kube-controller-manager
 func (lb *LoadBalancer) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	defer lb.forgetServiceLock(service)
+	unlock := lb.lockService(service)
+	defer unlock()
+
+	current, ok, err := lb.refreshService(service, false)
+	if err != nil {
+		return err
+	}
+	if ok {
+		service = current
+	}
+
+	if err := ValidateServiceAnnotations(service); err != nil {
+		// Annotation errors never block deletion: a Service being torn down
+		// may carry stale/invalid annotations from before it was fixed, and
+		// the load balancer still needs to go away.
+		lb.recordInvalidAnnotations(service, err)
+	}
+
+	if lb.lrucache != nil {
+		lb.lrucache.Remove(reconcileCacheKey(service))
+	}
+
 	LBVersion, err := getLoadBalancerVersion(service)
 	if err != nil {
 		return err
@@ -182,7 +555,17 @@ func (lb *LoadBalancer) EnsureLoadBalancerDeleted(ctx context.Context, clusterNa
 	return provider.EnsureLoadBalancerDeleted(ctx, clusterName, service)
 }
 
+// GetHealthCheckPort returns the port that should be health-checked for
+// service: the Service port whose port number equals the "port" of an
+// ELBHealthCheckOption annotation if present and valid, falling back to the
+// legacy HealthzCCE-named port.
 func GetHealthCheckPort(service *v1.Service) *v1.ServicePort {
+	if config, err := ParseLBServiceConfig(service); err == nil {
+		if port := healthCheckPortFromOption(service, config.HealthCheckOption); port != nil {
+			return port
+		}
+	}
+
 	for _, port := range service.Spec.Ports {
 		if port.Name == HealthzCCE {
 			return &port
@@ -191,6 +574,21 @@ func GetHealthCheckPort(service *v1.Service) *v1.ServicePort {
 	return nil
 }
 
+// healthCheckPortFromOption resolves option.Port to the matching
+// v1.ServicePort of service, or nil if option is unset or names no port on
+// the Service.
+func healthCheckPortFromOption(service *v1.Service, option *HealthCheckOption) *v1.ServicePort {
+	if option == nil || option.Port == 0 {
+		return nil
+	}
+	for i := range service.Spec.Ports {
+		if service.Spec.Ports[i].Port == option.Port {
+			return &service.Spec.Ports[i]
+		}
+	}
+	return nil
+}
+
 func GetListenerName(service *v1.Service) string {
 	return string(service.UID)
 }
@@ -206,9 +604,105 @@ func GetSessionAffinity(service *v1.Service) bool {
 	if service.Annotations[ELBSessionAffinityMode] == ELBSessionSourceIP {
 		return true
 	}
+	if flag, ok := service.Annotations[ELBSessionAffinityFlag]; ok {
+		return flag == "on" || flag == "true"
+	}
 	return false
 }
 
+// GetSessionAffinityOption returns the session-affinity tuning for service,
+// parsed from its ELBSessionAffinityOption annotation, defaulting to
+// DefaultSessionAffinityTime if the annotation is absent or invalid. Callers
+// that need to fail on invalid JSON should use ParseLBServiceConfig instead.
+func GetSessionAffinityOption(service *v1.Service) SessionAffinityOption {
+	if config, err := ParseLBServiceConfig(service); err == nil {
+		return config.SessionAffinityOption
+	}
+	return SessionAffinityOption{PersistenceTimeout: DefaultSessionAffinityTime}
+}
+
+// GetHealthCheckOption returns the health-check tuning for service, parsed
+// from its ELBHealthCheckOption annotation, or nil if the annotation is
+// absent or invalid. Callers that need to fail on invalid JSON should use
+// ParseLBServiceConfig instead.
+func GetHealthCheckOption(service *v1.Service) *HealthCheckOption {
+	if config, err := ParseLBServiceConfig(service); err == nil {
+		return config.HealthCheckOption
+	}
+	return nil
+}
+
+// SessionAffinityOption is the JSON schema of the ELBSessionAffinityOption
+// annotation.
+type SessionAffinityOption struct {
+	// PersistenceTimeout is how long, in minutes, a client is pinned to the
+	// same backend. Defaults to DefaultSessionAffinityTime.
+	PersistenceTimeout int `json:"persistence_timeout"`
+}
+
+// HealthCheckOption is the JSON schema of the ELBHealthCheckOption
+// annotation.
+type HealthCheckOption struct {
+	Protocol   string `json:"protocol"`
+	Port       int32  `json:"port"`
+	Interval   int    `json:"interval"`
+	Timeout    int    `json:"timeout"`
+	MaxRetries int    `json:"max_retries"`
+	Path       string `json:"path"`
+}
+
+// LBServiceConfig is the load-balancer-relevant configuration of a Service,
+// assembled by ParseLBServiceConfig from its annotations and spec.
+// ValidateServiceAnnotations uses it to reject malformed annotations before
+// a provider is invoked; GetSessionAffinity, GetSessionAffinityOption,
+// GetHealthCheckPort and GetHealthCheckOption expose its fields one at a
+// time for a provider to act on (source ranges need no such getter, as they
+// carry over to providers unchanged on service.Spec.LoadBalancerSourceRanges).
+type LBServiceConfig struct {
+	SessionAffinity       bool
+	SessionAffinityOption SessionAffinityOption
+	HealthCheckOption     *HealthCheckOption
+	SourceRanges          []string
+}
+
+// ParseLBServiceConfig parses and validates the session-affinity,
+// health-check and source-range configuration of service. It returns an
+// error if ELBSessionAffinityOption or ELBHealthCheckOption is present but
+// not valid JSON.
+func ParseLBServiceConfig(service *v1.Service) (*LBServiceConfig, error) {
+	config := &LBServiceConfig{
+		SessionAffinity: GetSessionAffinity(service),
+		SessionAffinityOption: SessionAffinityOption{
+			PersistenceTimeout: DefaultSessionAffinityTime,
+		},
+		SourceRanges: service.Spec.LoadBalancerSourceRanges,
+	}
+
+	if raw, ok := service.Annotations[ELBSessionAffinityOption]; ok && raw != "" {
+		if err := json.Unmarshal([]byte(raw), &config.SessionAffinityOption); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on service %s: %v", ELBSessionAffinityOption, service.Name, err)
+		}
+	}
+
+	if raw, ok := service.Annotations[ELBHealthCheckOption]; ok && raw != "" {
+		var option HealthCheckOption
+		if err := json.Unmarshal([]byte(raw), &option); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation on service %s: %v", ELBHealthCheckOption, service.Name, err)
+		}
+		config.HealthCheckOption = &option
+	}
+
+	return config, nil
+}
+
+// ValidateServiceAnnotations checks that every load-balancer-relevant
+// annotation on service is well-formed. It must be called before any
+// ELB/ALB/NAT API call is made for the service.
+func ValidateServiceAnnotations(service *v1.Service) error {
+	_, err := ParseLBServiceConfig(service)
+	return err
+}
+
 // if the node not health, it will not be added to ELB
 func CheckNodeHealth(node *v1.Node) (bool, error) {
 	conditionMap := make(map[v1.NodeConditionType]*v1.NodeCondition)
@@ -254,6 +748,9 @@ func getLoadBalancerVersion(service *v1.Service) (LoadBalanceVersion, error) {
 	case "dnat":
 		klog.Infof("DNAT for service %v", service.Name)
 		return VersionNAT, nil
+	case "upnp":
+		klog.Infof("UPnP-IGD for service %v", service.Name)
+		return VersionUPnP, nil
 	default:
 		return 0, fmt.Errorf("Load balancer version unknown")
 	}
@@ -0,0 +1,258 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package huaweicloud
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testService(ports []v1.ServicePort, sourceRanges []string, annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "default", Annotations: annotations},
+		Spec: v1.ServiceSpec{
+			Ports:                    ports,
+			LoadBalancerSourceRanges: sourceRanges,
+		},
+	}
+}
+
+func readyNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func TestNeedUpdate(t *testing.T) {
+	base := testService([]v1.ServicePort{{Port: 80}}, nil, nil)
+
+	tests := []struct {
+		name string
+		old  *v1.Service
+		new  *v1.Service
+		want bool
+	}{
+		{"nil old", nil, base, true},
+		{"identical", base, base.DeepCopy(), false},
+		{"ports changed", base, testService([]v1.ServicePort{{Port: 81}}, nil, nil), true},
+		{"source ranges changed", base, testService([]v1.ServicePort{{Port: 80}}, []string{"10.0.0.0/8"}, nil), true},
+		{"irrelevant annotation added", base, testService([]v1.ServicePort{{Port: 80}}, nil, map[string]string{"unrelated": "x"}), false},
+		{"elb annotation added", base, testService([]v1.ServicePort{{Port: 80}}, nil, map[string]string{ELBClassAnnotation: "union"}), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NeedUpdate(tt.old, tt.new); got != tt.want {
+				t.Errorf("NeedUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringSlicesEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want bool
+	}{
+		{"both nil", nil, nil, true},
+		{"equal", []string{"a", "b"}, []string{"a", "b"}, true},
+		{"different length", []string{"a"}, []string{"a", "b"}, false},
+		{"different order", []string{"a", "b"}, []string{"b", "a"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringSlicesEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("stringSlicesEqual() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLBServiceConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		config, err := ParseLBServiceConfig(testService(nil, nil, nil))
+		if err != nil {
+			t.Fatalf("ParseLBServiceConfig() error = %v", err)
+		}
+		if config.SessionAffinity {
+			t.Errorf("SessionAffinity = true, want false")
+		}
+		if config.SessionAffinityOption.PersistenceTimeout != DefaultSessionAffinityTime {
+			t.Errorf("PersistenceTimeout = %d, want %d", config.SessionAffinityOption.PersistenceTimeout, DefaultSessionAffinityTime)
+		}
+		if config.HealthCheckOption != nil {
+			t.Errorf("HealthCheckOption = %+v, want nil", config.HealthCheckOption)
+		}
+	})
+
+	t.Run("session affinity flag and option", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{
+			ELBSessionAffinityFlag:   "on",
+			ELBSessionAffinityOption: `{"persistence_timeout": 30}`,
+		})
+		config, err := ParseLBServiceConfig(svc)
+		if err != nil {
+			t.Fatalf("ParseLBServiceConfig() error = %v", err)
+		}
+		if !config.SessionAffinity {
+			t.Errorf("SessionAffinity = false, want true")
+		}
+		if config.SessionAffinityOption.PersistenceTimeout != 30 {
+			t.Errorf("PersistenceTimeout = %d, want 30", config.SessionAffinityOption.PersistenceTimeout)
+		}
+	})
+
+	t.Run("health check option", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{
+			ELBHealthCheckOption: `{"protocol": "HTTP", "port": 8080, "interval": 5, "timeout": 3, "max_retries": 2, "path": "/healthz"}`,
+		})
+		config, err := ParseLBServiceConfig(svc)
+		if err != nil {
+			t.Fatalf("ParseLBServiceConfig() error = %v", err)
+		}
+		if config.HealthCheckOption == nil {
+			t.Fatalf("HealthCheckOption = nil, want non-nil")
+		}
+		if config.HealthCheckOption.Protocol != "HTTP" || config.HealthCheckOption.Port != 8080 || config.HealthCheckOption.Path != "/healthz" {
+			t.Errorf("HealthCheckOption = %+v, want {Protocol:HTTP Port:8080 Path:/healthz ...}", config.HealthCheckOption)
+		}
+	})
+
+	t.Run("source ranges passed through", func(t *testing.T) {
+		svc := testService(nil, []string{"10.0.0.0/8", "192.168.0.0/16"}, nil)
+		config, err := ParseLBServiceConfig(svc)
+		if err != nil {
+			t.Fatalf("ParseLBServiceConfig() error = %v", err)
+		}
+		if !stringSlicesEqual(config.SourceRanges, svc.Spec.LoadBalancerSourceRanges) {
+			t.Errorf("SourceRanges = %v, want %v", config.SourceRanges, svc.Spec.LoadBalancerSourceRanges)
+		}
+	})
+
+	t.Run("invalid session affinity option JSON", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{ELBSessionAffinityOption: "{not json}"})
+		if _, err := ParseLBServiceConfig(svc); err == nil {
+			t.Errorf("ParseLBServiceConfig() error = nil, want error")
+		}
+	})
+
+	t.Run("invalid health check option JSON", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{ELBHealthCheckOption: "{not json}"})
+		if _, err := ParseLBServiceConfig(svc); err == nil {
+			t.Errorf("ParseLBServiceConfig() error = nil, want error")
+		}
+	})
+}
+
+func TestGetSessionAffinityOption(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		got := GetSessionAffinityOption(testService(nil, nil, nil))
+		if got.PersistenceTimeout != DefaultSessionAffinityTime {
+			t.Errorf("PersistenceTimeout = %d, want %d", got.PersistenceTimeout, DefaultSessionAffinityTime)
+		}
+	})
+
+	t.Run("from annotation", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{ELBSessionAffinityOption: `{"persistence_timeout": 30}`})
+		got := GetSessionAffinityOption(svc)
+		if got.PersistenceTimeout != 30 {
+			t.Errorf("PersistenceTimeout = %d, want 30", got.PersistenceTimeout)
+		}
+	})
+
+	t.Run("invalid annotation falls back to default", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{ELBSessionAffinityOption: "{not json}"})
+		got := GetSessionAffinityOption(svc)
+		if got.PersistenceTimeout != DefaultSessionAffinityTime {
+			t.Errorf("PersistenceTimeout = %d, want %d", got.PersistenceTimeout, DefaultSessionAffinityTime)
+		}
+	})
+}
+
+func TestGetHealthCheckOption(t *testing.T) {
+	t.Run("absent", func(t *testing.T) {
+		if got := GetHealthCheckOption(testService(nil, nil, nil)); got != nil {
+			t.Errorf("GetHealthCheckOption() = %+v, want nil", got)
+		}
+	})
+
+	t.Run("from annotation", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{
+			ELBHealthCheckOption: `{"protocol": "HTTP", "port": 8080, "interval": 5, "timeout": 3, "max_retries": 2, "path": "/healthz"}`,
+		})
+		got := GetHealthCheckOption(svc)
+		if got == nil {
+			t.Fatalf("GetHealthCheckOption() = nil, want non-nil")
+		}
+		if got.Protocol != "HTTP" || got.Port != 8080 || got.Interval != 5 || got.Timeout != 3 || got.MaxRetries != 2 || got.Path != "/healthz" {
+			t.Errorf("GetHealthCheckOption() = %+v, want full option", got)
+		}
+	})
+
+	t.Run("invalid annotation falls back to nil", func(t *testing.T) {
+		svc := testService(nil, nil, map[string]string{ELBHealthCheckOption: "{not json}"})
+		if got := GetHealthCheckOption(svc); got != nil {
+			t.Errorf("GetHealthCheckOption() = %+v, want nil", got)
+		}
+	})
+}
+
+func TestValidateServiceAnnotations(t *testing.T) {
+	if err := ValidateServiceAnnotations(testService(nil, nil, nil)); err != nil {
+		t.Errorf("ValidateServiceAnnotations() error = %v, want nil", err)
+	}
+
+	invalid := testService(nil, nil, map[string]string{ELBHealthCheckOption: "{not json}"})
+	if err := ValidateServiceAnnotations(invalid); err == nil {
+		t.Errorf("ValidateServiceAnnotations() error = nil, want error")
+	}
+}
+
+func TestNodeSlicesEqual(t *testing.T) {
+	nodeA := readyNode("a")
+	nodeB := readyNode("b")
+
+	notReadyA := readyNode("a")
+	notReadyA.Status.Conditions[0].Status = v1.ConditionFalse
+
+	tests := []struct {
+		name string
+		old  []*v1.Node
+		new  []*v1.Node
+		want bool
+	}{
+		{"same set", []*v1.Node{nodeA, nodeB}, []*v1.Node{nodeA, nodeB}, true},
+		{"different length", []*v1.Node{nodeA}, []*v1.Node{nodeA, nodeB}, false},
+		{"different membership", []*v1.Node{nodeA}, []*v1.Node{nodeB}, false},
+		{"health condition changed", []*v1.Node{nodeA}, []*v1.Node{notReadyA}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeSlicesEqual(tt.old, tt.new); got != tt.want {
+				t.Errorf("nodeSlicesEqual() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,468 @@
+/*
+Copyright 2020 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package huaweicloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	v1 "k8s.io/api/core/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+)
+
+const (
+	upnpSSDPAddr        = "239.255.255.250:1900"
+	upnpSearchTarget    = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpWANIPConnection = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	upnpDiscoverTimeout = 3 * time.Second
+	upnpLeaseDuration   = 3600
+	// upnpRefreshInterval is how often mappings are re-added, well inside
+	// upnpLeaseDuration, so a flaky IGD that silently drops a lease is
+	// repaired before it's noticed by clients.
+	upnpRefreshInterval = 10 * time.Minute
+)
+
+// UPnPCloud implements cloudprovider.LoadBalancer on top of a UPnP Internet
+// Gateway Device (IGD) discovered on the node network via SSDP. It gives
+// edge/on-prem HuaweiCloud clusters a way to expose Services without
+// provisioning an ELB, by punching <externalIP>:port -> <node>:nodePort
+// port mappings on the gateway.
+type UPnPCloud struct {
+	lrucache      *lru.Cache
+	config        *LoadBalancerOpts
+	kubeClient    corev1.CoreV1Interface
+	eventRecorder record.EventRecorder
+
+	mu        sync.Mutex
+	listeners map[string]*upnpListener // keyed by GetListenerName(service)
+}
+
+// upnpListener tracks the port mappings programmed for a single Service and
+// the background goroutine that keeps them refreshed.
+type upnpListener struct {
+	externalIP string
+	ports      []v1.ServicePort
+	targetAddr string
+	stopCh     chan struct{}
+}
+
+var _ cloudprovider.LoadBalancer = &UPnPCloud{}
+
+// GetLoadBalancer returns whether the specified load balancer exists, and
+// if so, what its status is.
+func (u *UPnPCloud) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (*v1.LoadBalancerStatus, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	listener, exists := u.listeners[GetListenerName(service)]
+	if !exists {
+		return nil, false, nil
+	}
+
+	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: listener.externalIP}}}, true, nil
+}
+
+// GetLoadBalancerName returns the name of the load balancer.
+func (u *UPnPCloud) GetLoadBalancerName(ctx context.Context, clusterName string, service *v1.Service) string {
+	return GetListenerName(service)
+}
+
+// EnsureLoadBalancer discovers the IGD on the node network, adds a port
+// mapping for every Service port to the first ready node, and starts a
+// background goroutine that keeps refreshing those mappings since UPnP
+// leases expire.
+func (u *UPnPCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	gateway, err := discoverGateway(upnpDiscoverTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover UPnP Internet Gateway Device: %v", err)
+	}
+
+	externalIP, err := gateway.getExternalIPAddress()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UPnP WAN IP address: %v", err)
+	}
+
+	targetAddr, err := firstReadyNodeAddress(nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.applyMappings(gateway, service, targetAddr); err != nil {
+		return nil, err
+	}
+
+	name := GetListenerName(service)
+
+	u.mu.Lock()
+	if existing, ok := u.listeners[name]; ok {
+		close(existing.stopCh)
+	}
+	listener := &upnpListener{
+		externalIP: externalIP,
+		ports:      service.Spec.Ports,
+		targetAddr: targetAddr,
+		stopCh:     make(chan struct{}),
+	}
+	u.listeners[name] = listener
+	u.mu.Unlock()
+
+	go u.refreshLoop(service.DeepCopy(), listener)
+
+	return &v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: externalIP}}}, nil
+}
+
+// UpdateLoadBalancer re-applies the port mappings against the (possibly
+// changed) first ready node.
+func (u *UPnPCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
+	gateway, err := discoverGateway(upnpDiscoverTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to discover UPnP Internet Gateway Device: %v", err)
+	}
+
+	targetAddr, err := firstReadyNodeAddress(nodes)
+	if err != nil {
+		return err
+	}
+
+	if err := u.applyMappings(gateway, service, targetAddr); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if listener, ok := u.listeners[GetListenerName(service)]; ok {
+		listener.ports = service.Spec.Ports
+		listener.targetAddr = targetAddr
+	}
+
+	return nil
+}
+
+// EnsureLoadBalancerDeleted removes the port mappings for the Service ports
+// recorded by the last EnsureLoadBalancer/UpdateLoadBalancer call and stops
+// the Service's refresh goroutine. Mappings for ports that an earlier call
+// added but a later one no longer lists are not removed.
+func (u *UPnPCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
+	name := GetListenerName(service)
+
+	u.mu.Lock()
+	listener, exists := u.listeners[name]
+	if exists {
+		delete(u.listeners, name)
+	}
+	u.mu.Unlock()
+
+	if !exists {
+		return nil
+	}
+	close(listener.stopCh)
+
+	gateway, err := discoverGateway(upnpDiscoverTimeout)
+	if err != nil {
+		klog.Warningf("failed to discover UPnP Internet Gateway Device while deleting mappings for service %s: %v", service.Name, err)
+		return nil
+	}
+
+	for _, port := range listener.ports {
+		if err := gateway.deletePortMapping(port); err != nil {
+			klog.Warningf("failed to delete UPnP port mapping %d for service %s: %v", port.Port, service.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// refreshLoop periodically re-adds the Service's port mappings since UPnP
+// leases expire on the IGD even when nothing on the cluster side changed.
+func (u *UPnPCloud) refreshLoop(service *v1.Service, listener *upnpListener) {
+	ticker := time.NewTicker(upnpRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-listener.stopCh:
+			return
+		case <-ticker.C:
+			gateway, err := discoverGateway(upnpDiscoverTimeout)
+			if err != nil {
+				klog.Warningf("UPnP mapping refresh: failed to discover gateway for service %s: %v", service.Name, err)
+				continue
+			}
+
+			// listener.ports/targetAddr are mutated by UpdateLoadBalancer
+			// under u.mu, so snapshot them under the same lock instead of
+			// reading the live fields here.
+			u.mu.Lock()
+			ports := append([]v1.ServicePort(nil), listener.ports...)
+			targetAddr := listener.targetAddr
+			u.mu.Unlock()
+
+			for _, port := range ports {
+				if err := gateway.addPortMapping(port, targetAddr); err != nil {
+					klog.Warningf("UPnP mapping refresh: failed to renew port %d for service %s: %v", port.Port, service.Name, err)
+				}
+			}
+		}
+	}
+}
+
+func (u *UPnPCloud) applyMappings(gateway *upnpGatewayClient, service *v1.Service, targetAddr string) error {
+	for _, port := range service.Spec.Ports {
+		if err := gateway.addPortMapping(port, targetAddr); err != nil {
+			return fmt.Errorf("failed to add UPnP port mapping for port %d: %v", port.Port, err)
+		}
+	}
+	return nil
+}
+
+// firstReadyNodeAddress returns the internal address of the first Ready
+// node, which is where the IGD's port mappings will point the NodePort
+// traffic at.
+func firstReadyNodeAddress(nodes []*v1.Node) (string, error) {
+	for _, node := range nodes {
+		healthy, err := CheckNodeHealth(node)
+		if err != nil || !healthy {
+			continue
+		}
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == v1.NodeInternalIP {
+				return addr.Address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no ready node with an internal IP address found")
+}
+
+// upnpGatewayClient is a minimal SOAP client bound to the WANIPConnection
+// control URL of a discovered Internet Gateway Device.
+type upnpGatewayClient struct {
+	controlURL string
+}
+
+// discoverGateway sends an SSDP M-SEARCH for an InternetGatewayDevice on the
+// local network, fetches its device description and returns a client bound
+// to the WANIPConnection control URL.
+func discoverGateway(timeout time.Duration) (*upnpGatewayClient, error) {
+	location, err := ssdpSearch(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	controlURL, err := fetchControlURL(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upnpGatewayClient{controlURL: controlURL}, nil
+}
+
+func ssdpSearch(timeout time.Duration) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", upnpSSDPAddr)
+	if err != nil {
+		return "", err
+	}
+
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + upnpSSDPAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + upnpSearchTarget + "\r\n\r\n"
+
+	if _, err := conn.WriteTo([]byte(request), addr); err != nil {
+		return "", err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return "", fmt.Errorf("no UPnP Internet Gateway Device responded: %v", err)
+		}
+
+		location := parseSSDPLocation(string(buf[:n]))
+		if location != "" {
+			return location, nil
+		}
+	}
+}
+
+func parseSSDPLocation(response string) string {
+	for _, line := range strings.Split(response, "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(parts[0]), "LOCATION") {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// upnpDevice, upnpDeviceDef and upnpServiceDef mirror just enough of the UPnP device
+// description XML schema to locate the WANIPConnection control URL.
+type upnpDevice struct {
+	XMLName xml.Name      `xml:"root"`
+	Device  upnpDeviceDef `xml:"device"`
+}
+
+type upnpDeviceDef struct {
+	DeviceList  []upnpDeviceDef  `xml:"deviceList>device"`
+	ServiceList []upnpServiceDef `xml:"serviceList>service"`
+}
+
+type upnpServiceDef struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+func fetchControlURL(location string) (string, error) {
+	resp, err := http.Get(location)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var device upnpDevice
+	if err := xml.NewDecoder(resp.Body).Decode(&device); err != nil {
+		return "", fmt.Errorf("failed to parse UPnP device description: %v", err)
+	}
+
+	service, found := findWANIPConnection(device.Device)
+	if !found {
+		return "", fmt.Errorf("UPnP device at %s does not expose a WANIPConnection service", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	control, err := url.Parse(service.ControlURL)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(control).String(), nil
+}
+
+func findWANIPConnection(device upnpDeviceDef) (upnpServiceDef, bool) {
+	for _, svc := range device.ServiceList {
+		if svc.ServiceType == upnpWANIPConnection {
+			return svc, true
+		}
+	}
+	for _, child := range device.DeviceList {
+		if svc, found := findWANIPConnection(child); found {
+			return svc, true
+		}
+	}
+	return upnpServiceDef{}, false
+}
+
+func (c *upnpGatewayClient) getExternalIPAddress() (string, error) {
+	type response struct {
+		ExternalIPAddress string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+
+	var resp response
+	if err := c.soapCall("GetExternalIPAddress", "", &resp); err != nil {
+		return "", err
+	}
+	return resp.ExternalIPAddress, nil
+}
+
+func (c *upnpGatewayClient) addPortMapping(port v1.ServicePort, targetAddr string) error {
+	args := fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost>"+
+			"<NewExternalPort>%d</NewExternalPort>"+
+			"<NewProtocol>%s</NewProtocol>"+
+			"<NewInternalPort>%d</NewInternalPort>"+
+			"<NewInternalClient>%s</NewInternalClient>"+
+			"<NewEnabled>1</NewEnabled>"+
+			"<NewPortMappingDescription>%s</NewPortMappingDescription>"+
+			"<NewLeaseDuration>%d</NewLeaseDuration>",
+		port.Port, strings.ToUpper(string(port.Protocol)), port.NodePort, targetAddr,
+		ListenerDescription, upnpLeaseDuration)
+
+	return c.soapCall("AddPortMapping", args, nil)
+}
+
+func (c *upnpGatewayClient) deletePortMapping(port v1.ServicePort) error {
+	args := fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost>"+
+			"<NewExternalPort>%d</NewExternalPort>"+
+			"<NewProtocol>%s</NewProtocol>",
+		port.Port, strings.ToUpper(string(port.Protocol)))
+
+	return c.soapCall("DeletePortMapping", args, nil)
+}
+
+// soapCall issues a SOAPACTION request against the gateway's WANIPConnection
+// control URL and, if out is non-nil, decodes the XML envelope body into it.
+func (c *upnpGatewayClient) soapCall(action, args string, out interface{}) error {
+	envelope := fmt.Sprintf(
+		`<?xml version="1.0"?>`+
+			`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+			`<s:Body><u:%s xmlns:u="%s">%s</u:%s></s:Body></s:Envelope>`,
+		action, upnpWANIPConnection, args, action)
+
+	req, err := http.NewRequest(http.MethodPost, c.controlURL, bytes.NewBufferString(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPACTION", strconv.Quote(upnpWANIPConnection+"#"+action))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("UPnP action %s failed with status %s", action, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}